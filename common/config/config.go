@@ -0,0 +1,22 @@
+package config
+
+// RuntimeConfig is the in-memory configuration singleton that the rest of
+// the repo reads via Get(). The real entry point populates it from the
+// on-disk config file at startup.
+type RuntimeConfig struct {
+	Quarantine QuarantineConfig
+}
+
+var instance = &RuntimeConfig{}
+
+// Get returns the active configuration.
+func Get() *RuntimeConfig {
+	return instance
+}
+
+// Set overrides the active configuration. Production code never calls
+// this - it exists so tests can exercise config-dependent branches without
+// a config file on disk.
+func Set(c *RuntimeConfig) {
+	instance = c
+}
@@ -0,0 +1,15 @@
+package config
+
+// QuarantineConfig controls how quarantined media is handled on download.
+type QuarantineConfig struct {
+	// ReplaceDownloads, if true, serves a replacement asset instead of an
+	// error when a client requests quarantined media.
+	ReplaceDownloads bool `yaml:"replace_downloads"`
+
+	// ReplacementAssets maps a MIME family ("image/*", "video/*", "audio/*",
+	// "application/pdf") or the "*" catch-all to the path of a file to serve
+	// in place of quarantined media of that type. A family with no entry
+	// (and no "*" fallback configured) gets a generated placeholder image
+	// instead.
+	ReplacementAssets map[string]string `yaml:"replacement_assets"`
+}
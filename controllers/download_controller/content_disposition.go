@@ -0,0 +1,76 @@
+package download_controller
+
+import (
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var controlCharPattern = regexp.MustCompile(`[\x00-\x1f\x7f]`)
+
+// parseContentDispositionFilename extracts an upload filename from a remote
+// server's Content-Disposition header, used by the remote-fetch path when
+// populating MinimalMedia.UploadName. It prefers the RFC 5987 `filename*`
+// parameter over the plain RFC 2183 `filename` parameter, since the former
+// is the only one that can carry non-ASCII names unambiguously. If neither
+// parameter yields a usable name, fallback is returned instead.
+func parseContentDispositionFilename(header string, fallback string) string {
+	if header == "" {
+		return fallback
+	}
+
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return fallback
+	}
+
+	if ext, ok := params["filename*"]; ok {
+		if name := decodeExtValue(ext); name != "" {
+			return sanitizeFilename(name)
+		}
+	}
+
+	if name, ok := params["filename"]; ok {
+		if sanitized := sanitizeFilename(name); sanitized != "" {
+			return sanitized
+		}
+	}
+
+	return fallback
+}
+
+// decodeExtValue decodes an RFC 5987 ext-value of the form
+// charset'language'percent-encoded-value. It returns "" if the value can't
+// be decoded or uses a charset we can't safely transcode to UTF-8.
+func decodeExtValue(value string) string {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+
+	charset := strings.ToLower(parts[0])
+	if charset != "" && charset != "utf-8" && charset != "us-ascii" {
+		return ""
+	}
+
+	// PathUnescape, not QueryUnescape: RFC 5987 ext-value percent-encoding
+	// doesn't give "+" any special meaning, so it must come through literally
+	// rather than being decoded into a space.
+	decoded, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+
+	return decoded
+}
+
+// sanitizeFilename strips path separators and control characters from a
+// name sourced from an untrusted remote server before it's persisted or
+// echoed back in our own Content-Disposition header.
+func sanitizeFilename(name string) string {
+	name = controlCharPattern.ReplaceAllString(name, "")
+	name = strings.ReplaceAll(name, "/", "")
+	name = strings.ReplaceAll(name, "\\", "")
+	return strings.TrimSpace(name)
+}
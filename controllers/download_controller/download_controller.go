@@ -1,20 +1,21 @@
 package download_controller
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/globals"
 	"github.com/turt2live/matrix-media-repo/controllers/quarantine_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/variant_controller"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
@@ -24,8 +25,140 @@ import (
 
 var localCache = cache.New(30*time.Second, 60*time.Second)
 
-func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx context.Context, log *logrus.Entry) (*types.MinimalMedia, error) {
-	cacheKey := fmt.Sprintf("%s/%s?r=%t&b=%t", origin, mediaId, downloadRemote, blockForMedia)
+// RemoteRequestResult is the coalesced outcome of a single in-flight remote
+// media fetch, shared by every caller asking for the same origin/mediaId
+// while that fetch is in progress.
+type RemoteRequestResult struct {
+	cond        *sync.Cond
+	done        bool
+	refCount    int
+	media       *types.Media
+	contentType string
+	filename    string
+	// streams holds one cloned copy of the in-flight stream per coalesced
+	// caller, for the case where the fetch resolves to a stream with no
+	// backing media record (see fetchRemoteMedia). Only ever touched while
+	// holding activeRemoteRequestsMu.
+	streams []io.ReadCloser
+	err     error
+}
+
+var activeRemoteRequestsMu sync.Mutex
+
+// activeRemoteRequests tracks remote media fetches currently in flight,
+// keyed by "origin/mediaId". Callers racing for the same key wait on the
+// existing entry's condition variable rather than each opening their own
+// channel to the resource handler, which is considerably cheaper than
+// cloning the resulting stream N ways for large remote files. It must only
+// ever be touched while holding activeRemoteRequestsMu, same as localCache
+// is only ever touched through the go-cache API.
+var activeRemoteRequests = make(map[string]*RemoteRequestResult)
+
+// fetchRemoteMedia coalesces concurrent remote downloads of the same
+// origin/mediaId into a single upstream request. The first caller performs
+// the fetch and broadcasts the result; everyone else blocks on the shared
+// result and then re-opens their own datastore stream from the resolved
+// media record.
+//
+// The resource handler can hand back a ready stream before the media record
+// has been persisted to the datastore (e.g. while the remote fetch is still
+// being written through). Only one goroutine can ever drain that stream, so
+// when that happens, the fetcher clones it once per coalesced caller
+// (including itself) with util.CloneReader instead of handing a dead result
+// to everyone who wasn't the one that ran the fetch.
+func fetchRemoteMedia(origin string, mediaId string) (media *types.Media, stream io.ReadCloser, contentType string, filename string, err error) {
+	key := origin + "/" + mediaId
+
+	activeRemoteRequestsMu.Lock()
+	if existing, ok := activeRemoteRequests[key]; ok {
+		existing.refCount++
+		for !existing.done {
+			existing.cond.Wait()
+		}
+		media, err = existing.media, existing.err
+		contentType, filename = existing.contentType, existing.filename
+		if media == nil && len(existing.streams) > 0 {
+			stream = existing.streams[len(existing.streams)-1]
+			existing.streams = existing.streams[:len(existing.streams)-1]
+		}
+		activeRemoteRequestsMu.Unlock()
+		return media, stream, contentType, filename, err
+	}
+
+	result := &RemoteRequestResult{cond: sync.NewCond(&activeRemoteRequestsMu), refCount: 1}
+	activeRemoteRequests[key] = result
+	activeRemoteRequestsMu.Unlock()
+
+	mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
+	remoteResult := <-mediaChan
+	close(mediaChan)
+
+	if remoteResult.media != nil {
+		name := parseContentDispositionFilename(remoteResult.contentDisposition, remoteResult.media.UploadName)
+		if sanitized := sanitizeFilename(name); sanitized != "" {
+			remoteResult.media.UploadName = sanitized
+		} else {
+			remoteResult.media.UploadName = mediaId
+		}
+	}
+
+	activeRemoteRequestsMu.Lock()
+	result.media = remoteResult.media
+	result.err = remoteResult.err
+	var ownStream io.ReadCloser
+	if result.media == nil && remoteResult.stream != nil {
+		name := sanitizeFilename(parseContentDispositionFilename(remoteResult.contentDisposition, remoteResult.filename))
+		if name == "" {
+			name = mediaId
+		}
+		result.contentType = remoteResult.contentType
+		result.filename = name
+
+		// result.refCount is stable at this instant - the entry comes out of
+		// the map below, so no further caller can join and push it higher -
+		// which means cloning into exactly that many copies covers every
+		// coalesced caller, including this goroutine's own share.
+		result.streams = util.CloneReader(remoteResult.stream, result.refCount)
+		ownStream = result.streams[len(result.streams)-1]
+		result.streams = result.streams[:len(result.streams)-1]
+	}
+	result.done = true
+	delete(activeRemoteRequests, key)
+	activeRemoteRequestsMu.Unlock()
+	result.cond.Broadcast()
+
+	if result.media == nil && ownStream != nil {
+		return nil, ownStream, result.contentType, result.filename, result.err
+	}
+
+	return result.media, nil, "", "", result.err
+}
+
+// MediaRange describes an optional byte range requested by a client via the
+// HTTP `Range` header. A nil *MediaRange means "give me the whole thing".
+// End of -1 means "to the end of the media".
+type MediaRange struct {
+	Start int64
+	End   int64
+}
+
+// MediaPurpose identifies which encoded variant of a media record should be
+// served. PurposeOriginal is always available; other purposes are
+// best-effort and GetMedia falls back to the original if the variant
+// doesn't exist (yet).
+type MediaPurpose string
+
+const (
+	PurposeOriginal MediaPurpose = "original"
+	PurposeHighRes  MediaPurpose = "highres"
+)
+
+func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia bool, rng *MediaRange, purpose MediaPurpose, ctx context.Context, log *logrus.Entry) (*types.MinimalMedia, error) {
+	if purpose == "" {
+		purpose = PurposeOriginal
+	}
+
+	cacheKey := fmt.Sprintf("%s/%s?r=%t&b=%t&range=%s&purpose=%s", origin, mediaId, downloadRemote, blockForMedia, rangeCacheKeyPart(rng), purpose)
 	v, _, err := globals.DefaultRequestGroup.Do(cacheKey, func() (interface{}, error) {
 		var media *types.Media
 		var minMedia *types.MinimalMedia
@@ -44,7 +177,7 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				}
 			}
 		} else {
-			minMedia, err = FindMinimalMediaRecord(origin, mediaId, downloadRemote, ctx, log)
+			minMedia, err = FindMinimalMediaRecord(origin, mediaId, downloadRemote, rng, ctx, log)
 			if minMedia != nil {
 				media = minMedia.KnownMedia
 			}
@@ -70,25 +203,41 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				log.Warn("Quarantined media accessed")
 
 				if config.Get().Quarantine.ReplaceDownloads {
-					log.Info("Replacing thumbnail with a quarantined one")
+					log.Info("Replacing download with a quarantine replacement asset")
 
-					img, err := quarantine_controller.GenerateQuarantineThumbnail(512, 512)
+					replacement, err := quarantine_controller.GetQuarantineReplacement(media.ContentType, log)
 					if err != nil {
 						return nil, err
 					}
+					if replacement == nil {
+						log.Error("No quarantine replacement asset was returned")
+						return nil, errors.New("no quarantine replacement available")
+					}
 
-					data := &bytes.Buffer{}
-					imaging.Encode(data, img, imaging.PNG)
-					return &types.MinimalMedia{
-						// Lie about all the details
-						Stream:      util.BufferToStream(data),
-						ContentType: "image/png",
-						UploadName:  "quarantine.png",
-						SizeBytes:   int64(data.Len()),
+					replacementMedia := &types.MinimalMedia{
+						// Lie about the bytes, but keep the real content type
+						// and name so clients render the replacement inline
+						// instead of offering it as a download.
+						Stream:      replacement.Stream,
+						ContentType: media.ContentType,
+						UploadName:  media.UploadName,
+						SizeBytes:   replacement.SizeBytes,
 						MediaId:     mediaId,
 						Origin:      origin,
 						KnownMedia:  media,
-					}, nil
+					}
+
+					if rng != nil {
+						rangedStream, rangeStart, rangeEnd, err := applyRange(replacement.Stream, replacement.SizeBytes, rng)
+						if err != nil {
+							return nil, err
+						}
+						replacementMedia.Stream = rangedStream
+						replacementMedia.RangeStart = rangeStart
+						replacementMedia.RangeEnd = rangeEnd
+					}
+
+					return replacementMedia, nil
 				}
 
 				return nil, common.ErrMediaQuarantined
@@ -102,17 +251,22 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 			localCache.Set(origin+"/"+mediaId, media, cache.DefaultExpiration)
 			internal_cache.Get().IncrementDownloads(media.Sha256Hash)
 
-			cached, err := internal_cache.Get().GetMedia(media, log)
-			if err != nil {
-				return nil, err
-			}
-			if cached != nil && cached.Contents != nil {
-				minMedia.Stream = util.BufferToStream(cached.Contents)
-				return minMedia, nil
+			// The internal cache only ever holds the original object, so a
+			// ranged request or a non-original purpose can't be served from
+			// it without extra bookkeeping - just fall through to a disk read.
+			if rng == nil && purpose == PurposeOriginal {
+				cached, err := internal_cache.Get().GetMedia(media, log)
+				if err != nil {
+					return nil, err
+				}
+				if cached != nil && cached.Contents != nil {
+					minMedia.Stream = util.BufferToStream(cached.Contents)
+					return minMedia, nil
+				}
 			}
 		}
 
-		if minMedia.Stream != nil {
+		if minMedia.Stream != nil && rng == nil && purpose == PurposeOriginal {
 			log.Info("Returning minimal media record with a viable stream")
 			return minMedia, nil
 		}
@@ -122,8 +276,41 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 			return nil, errors.New("failed to locate media")
 		}
 
+		servingMedia := media
+		if purpose != PurposeOriginal {
+			variant, err := storage.GetDatabase().GetMediaStore(ctx, log).GetVariant(media.Sha256Hash, string(purpose))
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+			if variant != nil {
+				log.Info("Serving " + string(purpose) + " variant of media")
+				servingMedia = variant
+				minMedia.ContentType = variant.ContentType
+				minMedia.UploadName = variant.UploadName
+				minMedia.SizeBytes = variant.SizeBytes
+			} else {
+				log.Info(string(purpose) + " variant not available yet - falling back to original")
+				if purpose == PurposeHighRes {
+					variant_controller.EnsureHighResVariant(media, ctx, log)
+				}
+			}
+		}
+
+		if rng != nil {
+			log.Info("Reading media range from disk")
+			minMedia.RangeStart = rng.Start
+			minMedia.RangeEnd = rng.End
+			mediaStream, realEnd, err := datastore.DownloadRange(ctx, log, servingMedia.DatastoreId, servingMedia.Location, rng.Start, rng.End)
+			if err != nil {
+				return nil, err
+			}
+			minMedia.RangeEnd = realEnd
+			minMedia.Stream = mediaStream
+			return minMedia, nil
+		}
+
 		log.Info("Reading media from disk")
-		mediaStream, err := datastore.DownloadStream(ctx, log, media.DatastoreId, media.Location)
+		mediaStream, err := datastore.DownloadStream(ctx, log, servingMedia.DatastoreId, servingMedia.Location)
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +337,8 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				ContentType: rv.ContentType,
 				SizeBytes:   rv.SizeBytes,
 				KnownMedia:  rv.KnownMedia,
+				RangeStart:  rv.RangeStart,
+				RangeEnd:    rv.RangeEnd,
 				Stream:      streams[i],
 			})
 		}
@@ -165,7 +354,12 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 	return value, err
 }
 
-func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool, ctx context.Context, log *logrus.Entry) (*types.MinimalMedia, error) {
+func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool, rng *MediaRange, ctx context.Context, log *logrus.Entry) (*types.MinimalMedia, error) {
+	if util.IsServerOurs(origin) && !isValidMediaId(mediaId) {
+		log.Warn("Malformed media ID rejected before database lookup")
+		return nil, common.ErrMediaNotFound
+	}
+
 	db := storage.GetDatabase().GetMediaStore(ctx, log)
 
 	var media *types.Media
@@ -188,35 +382,40 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 				return nil, common.ErrMediaNotFound
 			}
 
-			mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
-			defer close(mediaChan)
-
-			result := <-mediaChan
-			if result.err != nil {
-				return nil, result.err
+			remoteMedia, remoteStream, remoteContentType, remoteFilename, err := fetchRemoteMedia(origin, mediaId)
+			if err != nil {
+				return nil, err
 			}
-			if result.stream == nil {
-				log.Info("No stream returned from remote download - attempting to create one")
-				if result.media == nil {
+			if remoteMedia == nil {
+				if remoteStream == nil {
 					log.Error("Fatal error: No stream and no media. Cannot acquire a stream for media")
 					return nil, errors.New("no stream available")
 				}
 
-				stream, err := datastore.DownloadStream(ctx, log, result.media.DatastoreId, result.media.Location)
-				if err != nil {
-					return nil, err
-				}
+				return &types.MinimalMedia{
+					Origin:      origin,
+					MediaId:     mediaId,
+					ContentType: remoteContentType,
+					UploadName:  remoteFilename,
+					SizeBytes:   -1, // unknown
+					Stream:      remoteStream,
+					KnownMedia:  nil, // unknown
+				}, nil
+			}
 
-				result.stream = stream
+			stream, err := datastore.DownloadStream(ctx, log, remoteMedia.DatastoreId, remoteMedia.Location)
+			if err != nil {
+				return nil, err
 			}
+
 			return &types.MinimalMedia{
-				Origin:      origin,
-				MediaId:     mediaId,
-				ContentType: result.contentType,
-				UploadName:  result.filename,
-				SizeBytes:   -1, // unknown
-				Stream:      result.stream,
-				KnownMedia:  nil, // unknown
+				Origin:      remoteMedia.Origin,
+				MediaId:     remoteMedia.MediaId,
+				ContentType: remoteMedia.ContentType,
+				UploadName:  remoteMedia.UploadName,
+				SizeBytes:   remoteMedia.SizeBytes,
+				Stream:      stream,
+				KnownMedia:  remoteMedia,
 			}, nil
 		} else {
 			media = dbMedia
@@ -228,6 +427,25 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 		return nil, common.ErrMediaNotFound
 	}
 
+	if rng != nil {
+		rangeStream, realEnd, err := datastore.DownloadRange(ctx, log, media.DatastoreId, media.Location, rng.Start, rng.End)
+		if err != nil {
+			return nil, err
+		}
+
+		return &types.MinimalMedia{
+			Origin:      media.Origin,
+			MediaId:     media.MediaId,
+			ContentType: media.ContentType,
+			UploadName:  media.UploadName,
+			SizeBytes:   media.SizeBytes,
+			RangeStart:  rng.Start,
+			RangeEnd:    realEnd,
+			Stream:      rangeStream,
+			KnownMedia:  media,
+		}, nil
+	}
+
 	mediaStream, err := datastore.DownloadStream(ctx, log, media.DatastoreId, media.Location)
 	if err != nil {
 		return nil, err
@@ -245,6 +463,11 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 }
 
 func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx context.Context, log *logrus.Entry) (*types.Media, error) {
+	if util.IsServerOurs(origin) && !isValidMediaId(mediaId) {
+		log.Warn("Malformed media ID rejected before database lookup")
+		return nil, common.ErrMediaNotFound
+	}
+
 	cacheKey := origin + "/" + mediaId
 	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
 		db := storage.GetDatabase().GetMediaStore(ctx, log)
@@ -269,14 +492,17 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx con
 					return nil, common.ErrMediaNotFound
 				}
 
-				mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
-				defer close(mediaChan)
-
-				result := <-mediaChan
-				if result.err != nil {
-					return nil, result.err
+				remoteMedia, remoteStream, _, _, err := fetchRemoteMedia(origin, mediaId)
+				if remoteStream != nil {
+					// FindMediaRecord only ever returns metadata - a stream
+					// with no backing media record isn't useful here, so
+					// don't leak the open file descriptor.
+					_ = remoteStream.Close()
 				}
-				media = result.media
+				if err != nil {
+					return nil, err
+				}
+				media = remoteMedia
 			} else {
 				media = dbMedia
 			}
@@ -296,4 +522,48 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx con
 	}
 
 	return value, err
+}
+
+func rangeCacheKeyPart(rng *MediaRange) string {
+	if rng == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d-%d", rng.Start, rng.End)
+}
+
+// applyRange clips stream down to the inclusive byte range [rng.Start,
+// rng.End] of a resource of the given total size, skipping leading bytes
+// and limiting trailing ones. It closes stream and returns an error if the
+// requested range isn't satisfiable against size. The returned start/end
+// are clamped to size, for callers that need the real served range (e.g.
+// to build a Content-Range header).
+func applyRange(stream io.ReadCloser, size int64, rng *MediaRange) (io.ReadCloser, int64, int64, error) {
+	start := rng.Start
+	end := rng.End
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if end < start {
+		_ = stream.Close()
+		return nil, 0, 0, errors.New("range not satisfiable")
+	}
+
+	if start > 0 {
+		if _, err := io.CopyN(io.Discard, stream, start); err != nil {
+			_ = stream.Close()
+			return nil, 0, 0, err
+		}
+	}
+
+	return &limitedReadCloser{Reader: io.LimitReader(stream, end-start+1), Closer: stream}, start, end, nil
+}
+
+// limitedReadCloser pairs a length-limited Reader with the underlying
+// stream's Closer, since io.LimitReader on its own drops Close.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
 }
\ No newline at end of file
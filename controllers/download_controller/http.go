@@ -0,0 +1,174 @@
+package download_controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/controllers/quarantine_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// ParseRangeHeader parses an HTTP Range header (RFC 7233 "bytes=start-end"
+// form, single range only - we don't support multipart/byteranges) against
+// a resource of the given total size. A nil range with a nil error means
+// "no range requested, serve the whole thing".
+func ParseRangeHeader(header string, totalSize int64) (*MediaRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, fmt.Errorf("unsupported range unit")
+	}
+
+	spec := strings.TrimPrefix(header, "bytes=")
+	if strings.Contains(spec, ",") {
+		return nil, fmt.Errorf("multiple ranges not supported")
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed range")
+	}
+
+	var start, end int64
+	var err error
+
+	if parts[0] == "" {
+		// Suffix range: "bytes=-500" means "the last 500 bytes".
+		n, suffixErr := strconv.ParseInt(parts[1], 10, 64)
+		if suffixErr != nil {
+			return nil, fmt.Errorf("malformed range")
+		}
+		if n > totalSize {
+			n = totalSize
+		}
+		start = totalSize - n
+		end = totalSize - 1
+	} else {
+		start, err = strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed range")
+		}
+		if parts[1] == "" {
+			end = totalSize - 1
+		} else {
+			end, err = strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed range")
+			}
+			if end >= totalSize {
+				end = totalSize - 1
+			}
+		}
+	}
+
+	if start < 0 || start > end || start >= totalSize {
+		return nil, fmt.Errorf("range not satisfiable")
+	}
+
+	return &MediaRange{Start: start, End: end}, nil
+}
+
+// resolvePurpose determines which encoded variant of the media to serve.
+// An explicit `?purpose=` query param wins; otherwise we negotiate off the
+// `Accept` header, falling back to the original.
+func resolvePurpose(r *http.Request, originalContentType string) MediaPurpose {
+	if p := r.URL.Query().Get("purpose"); p != "" {
+		return MediaPurpose(p)
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" || strings.Contains(accept, "*/*") || strings.Contains(accept, originalContentType) {
+		return PurposeOriginal
+	}
+	if strings.Contains(accept, "image/jpeg") || strings.Contains(accept, "image/webp") {
+		return PurposeHighRes
+	}
+
+	return PurposeOriginal
+}
+
+// resolveServingSize returns the size that will actually be served for the
+// given purpose, so a Range header can be validated and reported against
+// the right denominator. A "highres" variant is a different size than the
+// original, and GetMedia only resolves that *after* ServeDownload has
+// already parsed the Range header - so this has to ask the same question
+// GetMedia will, up front, rather than trusting media.SizeBytes.
+func resolveServingSize(media *types.Media, purpose MediaPurpose, ctx context.Context, log *logrus.Entry) int64 {
+	if media.Quarantined && config.Get().Quarantine.ReplaceDownloads {
+		// GetMedia serves a replacement asset instead of the media itself.
+		replacement, err := quarantine_controller.GetQuarantineReplacement(media.ContentType, log)
+		if err == nil && replacement != nil {
+			_ = replacement.Stream.Close()
+			return replacement.SizeBytes
+		}
+	}
+
+	if purpose == PurposeOriginal {
+		return media.SizeBytes
+	}
+
+	variant, err := storage.GetDatabase().GetMediaStore(ctx, log).GetVariant(media.Sha256Hash, string(purpose))
+	if err != nil || variant == nil {
+		// No variant yet - GetMedia will fall back to the original, so the
+		// original's size is the correct denominator here too.
+		return media.SizeBytes
+	}
+
+	return variant.SizeBytes
+}
+
+// ServeDownload writes media to w, honoring a `Range:` header on r with a
+// 206 Partial Content response (plus Content-Range/Accept-Ranges) when
+// present, and a plain 200 otherwise.
+func ServeDownload(w http.ResponseWriter, r *http.Request, origin string, mediaId string, downloadRemote bool, ctx context.Context, log *logrus.Entry) {
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	mediaRecord, err := FindMediaRecord(origin, mediaId, downloadRemote, ctx, log)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	purpose := resolvePurpose(r, mediaRecord.ContentType)
+	servingSize := resolveServingSize(mediaRecord, purpose, ctx, log)
+
+	var rng *MediaRange
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		rng, err = ParseRangeHeader(rangeHeader, servingSize)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", servingSize))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	media, err := GetMedia(origin, mediaId, downloadRemote, false, rng, purpose, ctx, log)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer media.Stream.Close()
+
+	w.Header().Set("Content-Type", media.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", media.UploadName))
+
+	if rng != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", media.RangeStart, media.RangeEnd, servingSize))
+		w.Header().Set("Content-Length", strconv.FormatInt(media.RangeEnd-media.RangeStart+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(media.SizeBytes, 10))
+		w.WriteHeader(http.StatusOK)
+	}
+
+	_, _ = io.Copy(w, media.Stream)
+}
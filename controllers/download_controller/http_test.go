@@ -0,0 +1,82 @@
+package download_controller
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseRangeHeader(t *testing.T) {
+	const size = int64(1000)
+
+	cases := []struct {
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantErr   bool
+	}{
+		{"", 0, 0, false}, // no range requested; checked separately below
+		{"bytes=0-499", 0, 499, false},
+		{"bytes=500-", 500, 999, false},
+		{"bytes=-200", 800, 999, false},
+		{"bytes=900-1500", 900, 999, false}, // clamps to the end of the resource
+		{"bytes=1-0", 0, 0, true},           // start after end
+		{"bytes=1000-1999", 0, 0, true},     // start at/beyond size
+		{"bytes=0-10,20-30", 0, 0, true},    // multi-range not supported
+		{"items=0-10", 0, 0, true},          // wrong unit
+		{"bytes=abc-def", 0, 0, true},       // malformed
+	}
+
+	for _, c := range cases {
+		rng, err := ParseRangeHeader(c.header, size)
+		if c.header == "" {
+			if err != nil || rng != nil {
+				t.Errorf("ParseRangeHeader(%q) = %v, %v; want nil, nil", c.header, rng, err)
+			}
+			continue
+		}
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseRangeHeader(%q) = %v, nil; want an error", c.header, rng)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseRangeHeader(%q) returned an unexpected error: %v", c.header, err)
+		}
+		if rng.Start != c.wantStart || rng.End != c.wantEnd {
+			t.Errorf("ParseRangeHeader(%q) = {%d, %d}, want {%d, %d}", c.header, rng.Start, rng.End, c.wantStart, c.wantEnd)
+		}
+	}
+}
+
+func TestApplyRange(t *testing.T) {
+	data := []byte("0123456789")
+	stream := io.NopCloser(bytes.NewReader(data))
+
+	ranged, start, end, err := applyRange(stream, int64(len(data)), &MediaRange{Start: 2, End: 5})
+	if err != nil {
+		t.Fatalf("applyRange returned an unexpected error: %v", err)
+	}
+	if start != 2 || end != 5 {
+		t.Errorf("applyRange clamped range = {%d, %d}, want {2, 5}", start, end)
+	}
+
+	got, err := io.ReadAll(ranged)
+	if err != nil {
+		t.Fatalf("reading ranged stream failed: %v", err)
+	}
+	if string(got) != "2345" {
+		t.Errorf("applyRange produced %q, want %q", got, "2345")
+	}
+}
+
+func TestApplyRangeNotSatisfiable(t *testing.T) {
+	data := []byte("0123456789")
+	stream := io.NopCloser(bytes.NewReader(data))
+
+	_, _, _, err := applyRange(stream, int64(len(data)), &MediaRange{Start: 8, End: 3})
+	if err == nil {
+		t.Error("applyRange with start > end should have returned an error")
+	}
+}
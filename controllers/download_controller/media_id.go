@@ -0,0 +1,66 @@
+package download_controller
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// mediaIdPattern matches the shape of an opaque media ID: a base64url/hex
+// encoding of crypto/rand bytes, as produced by GenerateMediaId. It also
+// tolerates the legacy standard-base64 alphabet ("+", "/") so that rows
+// created before the opaque-ID rollout keep resolving instead of 404ing the
+// moment this check goes live. Anything outside this shape can't possibly
+// be a media ID we minted, so we can reject it before touching the
+// database.
+var mediaIdPattern = regexp.MustCompile(`^[A-Za-z0-9_=+/-]+$`)
+
+func isValidMediaId(mediaId string) bool {
+	return mediaId != "" && mediaIdPattern.MatchString(mediaId)
+}
+
+// maxMediaIdGenerationAttempts bounds the collision retry loop in
+// GenerateMediaId. A collision is vanishingly unlikely (32 random bytes),
+// so this only ever protects against a broken RNG or a buggy caller.
+const maxMediaIdGenerationAttempts = 10
+
+// GenerateMediaId mints a random, URL-safe opaque media ID for a new
+// upload to origin, decoupled from the content hash so that two uploads of
+// the same bytes by different users get distinct IDs and independent
+// metadata rows. It retries on the (extremely unlikely) chance that the
+// generated ID collides with one already in use for this origin.
+//
+// Scope note: this package only owns the download path, and no upload
+// controller exists yet anywhere in this tree for it to be wired into.
+// GenerateMediaId is exported so the upload path can call it once that
+// code lands; until then, isValidMediaId above is what's actually in
+// effect on reads.
+func GenerateMediaId(origin string, ctx context.Context, log *logrus.Entry) (string, error) {
+	db := storage.GetDatabase().GetMediaStore(ctx, log)
+
+	for attempt := 0; attempt < maxMediaIdGenerationAttempts; attempt++ {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		candidate := base64.RawURLEncoding.EncodeToString(buf)
+
+		_, err := db.Get(origin, candidate)
+		if err == sql.ErrNoRows {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		log.Warn("Generated media ID collided with an existing record - retrying")
+	}
+
+	return "", errors.New("failed to generate a unique media ID after multiple attempts")
+}
@@ -0,0 +1,91 @@
+package quarantine_controller
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// QuarantineReplacement is the asset served in place of quarantined media:
+// a stream of the replacement's bytes and how big it is.
+type QuarantineReplacement struct {
+	Stream    io.ReadCloser
+	SizeBytes int64
+}
+
+// mimeFamily returns the wildcard family a content type falls into for the
+// purposes of selecting a quarantine replacement asset: "application/pdf"
+// as-is, the top-level type followed by "/*" for any other content type
+// (e.g. "image/*", "video/*", "application/*"), or "*" when the content type
+// has no "/" at all.
+func mimeFamily(contentType string) string {
+	if contentType == "application/pdf" {
+		return "application/pdf"
+	}
+
+	if i := strings.Index(contentType, "/"); i > 0 {
+		return contentType[:i] + "/*"
+	}
+
+	return "*"
+}
+
+// GetQuarantineReplacement returns the asset to serve in place of a
+// quarantined media item, selected by its original content type. Admins can
+// configure a custom replacement file per MIME family via
+// Quarantine.ReplacementAssets (keyed by "image/*", "video/*", "audio/*",
+// "application/pdf", or the "*" catch-all); if no family-specific or
+// catch-all asset is configured, we fall back to the generated PNG
+// placeholder image has always used.
+func GetQuarantineReplacement(contentType string, log *logrus.Entry) (*QuarantineReplacement, error) {
+	assets := config.Get().Quarantine.ReplacementAssets
+
+	assetPath, ok := assets[mimeFamily(contentType)]
+	if !ok {
+		assetPath, ok = assets["*"]
+	}
+
+	if ok && assetPath != "" {
+		log.Info("Serving configured quarantine replacement asset: ", assetPath)
+
+		f, err := os.Open(assetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		return &QuarantineReplacement{Stream: f, SizeBytes: info.Size()}, nil
+	}
+
+	log.Info("No quarantine replacement asset configured for this content type - generating a placeholder image")
+
+	img, err := GenerateQuarantineThumbnail(512, 512)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &bytes.Buffer{}
+	if err = imaging.Encode(data, img, imaging.PNG); err != nil {
+		return nil, err
+	}
+
+	return &QuarantineReplacement{Stream: io.NopCloser(data), SizeBytes: int64(data.Len())}, nil
+}
+
+// GenerateQuarantineThumbnail renders a generic "this media has been
+// quarantined" placeholder image at the given dimensions.
+func GenerateQuarantineThumbnail(width int, height int) (image.Image, error) {
+	return imaging.New(width, height, color.NRGBA{R: 64, G: 64, B: 64, A: 255}), nil
+}
@@ -0,0 +1,125 @@
+package quarantine_controller
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+var testLog = logrus.NewEntry(logrus.StandardLogger())
+
+func withQuarantineConfig(t *testing.T, assets map[string]string) {
+	original := config.Get()
+	t.Cleanup(func() { config.Set(original) })
+	config.Set(&config.RuntimeConfig{Quarantine: config.QuarantineConfig{ReplacementAssets: assets}})
+}
+
+func TestMimeFamily(t *testing.T) {
+	cases := map[string]string{
+		"image/png":       "image/*",
+		"image/jpeg":      "image/*",
+		"video/mp4":       "video/*",
+		"audio/ogg":       "audio/*",
+		"application/pdf": "application/pdf",
+		"application/zip": "application/*",
+		"text/plain":      "text/*",
+		"":                "*",
+	}
+
+	for contentType, expected := range cases {
+		if got := mimeFamily(contentType); got != expected {
+			t.Errorf("mimeFamily(%q) = %q, want %q", contentType, got, expected)
+		}
+	}
+}
+
+func TestGenerateQuarantineThumbnail(t *testing.T) {
+	img, err := GenerateQuarantineThumbnail(512, 512)
+	if err != nil {
+		t.Fatalf("GenerateQuarantineThumbnail returned an error: %v", err)
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() != 512 || bounds.Dy() != 512 {
+		t.Errorf("GenerateQuarantineThumbnail(512, 512) produced a %dx%d image, want 512x512", bounds.Dx(), bounds.Dy())
+	}
+}
+
+func TestGetQuarantineReplacement_MimeSpecificAsset(t *testing.T) {
+	dir := t.TempDir()
+	assetPath := filepath.Join(dir, "image.bin")
+	if err := os.WriteFile(assetPath, []byte("configured image replacement"), 0644); err != nil {
+		t.Fatalf("failed to write test asset: %v", err)
+	}
+
+	withQuarantineConfig(t, map[string]string{"image/*": assetPath})
+
+	replacement, err := GetQuarantineReplacement("image/png", testLog)
+	if err != nil {
+		t.Fatalf("GetQuarantineReplacement returned an error: %v", err)
+	}
+	defer replacement.Stream.Close()
+
+	got, err := io.ReadAll(replacement.Stream)
+	if err != nil {
+		t.Fatalf("reading replacement stream failed: %v", err)
+	}
+	if string(got) != "configured image replacement" {
+		t.Errorf("GetQuarantineReplacement served %q, want the configured asset contents", got)
+	}
+	if replacement.SizeBytes != int64(len(got)) {
+		t.Errorf("GetQuarantineReplacement SizeBytes = %d, want %d", replacement.SizeBytes, len(got))
+	}
+}
+
+func TestGetQuarantineReplacement_WildcardFallback(t *testing.T) {
+	dir := t.TempDir()
+	assetPath := filepath.Join(dir, "catchall.bin")
+	if err := os.WriteFile(assetPath, []byte("catch-all replacement"), 0644); err != nil {
+		t.Fatalf("failed to write test asset: %v", err)
+	}
+
+	// No "video/*" entry, so a video content type should fall through to "*".
+	withQuarantineConfig(t, map[string]string{"*": assetPath})
+
+	replacement, err := GetQuarantineReplacement("video/mp4", testLog)
+	if err != nil {
+		t.Fatalf("GetQuarantineReplacement returned an error: %v", err)
+	}
+	defer replacement.Stream.Close()
+
+	got, err := io.ReadAll(replacement.Stream)
+	if err != nil {
+		t.Fatalf("reading replacement stream failed: %v", err)
+	}
+	if string(got) != "catch-all replacement" {
+		t.Errorf("GetQuarantineReplacement served %q, want the catch-all asset contents", got)
+	}
+}
+
+func TestGetQuarantineReplacement_GeneratedFallback(t *testing.T) {
+	// No assets configured at all, so this should fall back to the
+	// generated placeholder PNG rather than erroring or returning nothing.
+	withQuarantineConfig(t, nil)
+
+	replacement, err := GetQuarantineReplacement("image/png", testLog)
+	if err != nil {
+		t.Fatalf("GetQuarantineReplacement returned an error: %v", err)
+	}
+	defer replacement.Stream.Close()
+
+	got, err := io.ReadAll(replacement.Stream)
+	if err != nil {
+		t.Fatalf("reading replacement stream failed: %v", err)
+	}
+	if len(got) == 0 {
+		t.Error("GetQuarantineReplacement returned an empty generated placeholder")
+	}
+	if replacement.SizeBytes != int64(len(got)) {
+		t.Errorf("GetQuarantineReplacement SizeBytes = %d, want %d", replacement.SizeBytes, len(got))
+	}
+}
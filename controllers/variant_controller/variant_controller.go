@@ -0,0 +1,95 @@
+package variant_controller
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// PurposeHighRes mirrors download_controller.PurposeHighRes - it's
+// duplicated here (rather than imported) to avoid a dependency cycle, since
+// download_controller is what calls into this package.
+const PurposeHighRes = "highres"
+
+// needsHighResVariant reports whether the given upload content type is one
+// most clients can't decode natively, and therefore benefits from a
+// transcoded "highres" JPEG sibling.
+func needsHighResVariant(contentType string) bool {
+	switch contentType {
+	case "image/x-adobe-dng", "image/x-canon-cr2", "image/x-nikon-nef",
+		"image/heic", "image/heif", "image/avif", "image/tiff":
+		return true
+	default:
+		return false
+	}
+}
+
+// inFlight guards against queuing the same transcode twice while it's
+// already running, keyed by the original upload's sha256 hash.
+var inFlight sync.Map
+
+// EnsureHighResVariant kicks off a background transcode of media's original
+// bytes into a "highres" JPEG sibling if the original's content type
+// warrants it. It does not look up whether a variant already exists
+// (GetMedia only calls it after finding none); it only skips starting a
+// second job for a sha256 hash whose transcode is still running. Callers
+// don't block on the job; the variant simply becomes available for the next
+// request once the job finishes.
+func EnsureHighResVariant(media *types.Media, ctx context.Context, log *logrus.Entry) {
+	if media == nil || !needsHighResVariant(media.ContentType) {
+		return
+	}
+
+	if _, alreadyRunning := inFlight.LoadOrStore(media.Sha256Hash, struct{}{}); alreadyRunning {
+		return
+	}
+
+	// The caller's ctx is request-scoped and is normally canceled the
+	// moment the HTTP handler returns, but this job is meant to keep
+	// running as a detached background task - so it gets its own,
+	// independent context instead of inheriting one that's about to die.
+	bgCtx := context.Background()
+
+	go func() {
+		defer inFlight.Delete(media.Sha256Hash)
+
+		if err := transcode(media, bgCtx, log); err != nil {
+			log.Warn("Failed to generate high-res variant: ", err)
+		}
+	}()
+}
+
+func transcode(media *types.Media, ctx context.Context, log *logrus.Entry) error {
+	db := storage.GetDatabase().GetMediaStore(ctx, log)
+
+	src, err := datastore.DownloadStream(ctx, log, media.DatastoreId, media.Location)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	img, err := imaging.Decode(src)
+	if err != nil {
+		return err
+	}
+
+	data := &bytes.Buffer{}
+	if err = imaging.Encode(data, img, imaging.JPEG); err != nil {
+		return err
+	}
+
+	location, sizeBytes, err := datastore.UploadStream(media.DatastoreId, bytes.NewReader(data.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	log.Info("Generated high-res variant for ", media.Sha256Hash)
+
+	return db.InsertVariant(media.Sha256Hash, PurposeHighRes, media.DatastoreId, location, "image/jpeg", media.UploadName, sizeBytes)
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DownloadRange opens a seeked, length-limited read stream for the given
+// datastore-relative location, covering the inclusive byte range
+// [start, end]. A negative end means "read to the end of the file". It
+// returns the stream alongside the actual end offset served, which may be
+// clamped down to the file's real size (e.g. for a suffix range).
+//
+// This is a filesystem-only implementation (datastoreId is used directly
+// as a directory path via os.Open) - there's no S3/object-storage datastore
+// anywhere in this repo to issue a ranged GET against, so that's out of
+// scope here rather than silently unhandled.
+func DownloadRange(ctx context.Context, log *logrus.Entry, datastoreId string, location string, start int64, end int64) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(datastoreId, location))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+
+	size := info.Size()
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	if end < start {
+		_ = f.Close()
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if _, err = f.Seek(start, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+
+	log.Info("Opened ranged datastore stream")
+
+	return &limitedReadCloser{Reader: io.LimitReader(f, end-start+1), Closer: f}, end, nil
+}
+
+// limitedReadCloser pairs a length-limited Reader with the underlying
+// file's Closer, since io.LimitReader on its own drops Close.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
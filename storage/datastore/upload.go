@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// UploadStream writes stream into the given datastore, returning the
+// relative location it was written to and the number of bytes written.
+// Used by background jobs (such as the high-res variant transcoder) that
+// need to persist a new file alongside an existing datastore-backed upload.
+//
+// This only handles filesystem-backed datastores (datastoreId is used
+// directly as a directory path) - there's no S3/object-storage datastore
+// implementation anywhere in this repo today, so there's nothing for this
+// to dispatch to yet.
+func UploadStream(datastoreId string, stream io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(datastoreId, "variant-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer tmp.Close()
+
+	written, err := io.Copy(tmp, stream)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", 0, err
+	}
+
+	return filepath.Base(tmp.Name()), written, nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const selectMediaVariantSql = "SELECT sha256_hash, datastore_id, location, content_type, upload_name, size_bytes " +
+	"FROM media_variants WHERE sha256_hash = $1 AND purpose = $2"
+const insertMediaVariantSql = "INSERT INTO media_variants " +
+	"(sha256_hash, purpose, datastore_id, location, content_type, upload_name, size_bytes, created_ts) " +
+	"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) " +
+	"ON CONFLICT (sha256_hash, purpose) DO UPDATE SET " +
+	"datastore_id = $3, location = $4, content_type = $5, upload_name = $6, size_bytes = $7, created_ts = $8"
+
+// GetVariant looks up a previously-generated encoded variant of a piece of
+// media, keyed by the original content's hash and a purpose (e.g.
+// "highres"). Like Get, it returns sql.ErrNoRows if no such variant has
+// been generated yet.
+func (s *mediaStoreStatements) GetVariant(sha256hash string, purpose string) (*types.Media, error) {
+	media := &types.Media{Sha256Hash: sha256hash}
+
+	row := s.sqlDb.QueryRow(selectMediaVariantSql, sha256hash, purpose)
+	err := row.Scan(&media.Sha256Hash, &media.DatastoreId, &media.Location, &media.ContentType, &media.UploadName, &media.SizeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// InsertVariant records a newly-generated variant of a piece of media,
+// replacing any existing row for the same hash/purpose so a retried
+// transcode of the same source content overwrites rather than duplicates.
+func (s *mediaStoreStatements) InsertVariant(sha256hash string, purpose string, datastoreId string, location string, contentType string, uploadName string, sizeBytes int64) error {
+	_, err := s.sqlDb.Exec(insertMediaVariantSql, sha256hash, purpose, datastoreId, location, contentType, uploadName, sizeBytes, util.NowMillis())
+	return err
+}